@@ -5,6 +5,8 @@
 package captcha
 
 import (
+	"container/heap"
+	"context"
 	"sync"
 	"time"
 )
@@ -16,6 +18,12 @@ import (
 // It is the responsibility of an object to delete expired and used captchas
 // when necessary (for example, the default memory store collects them in Set
 // method after the certain amount of captchas has been stored.)
+//
+// Store cannot report backend errors (a network-backed store such as
+// NewRedisStore simply fails silently) or be cancelled. Implementations that
+// need either should additionally implement StoreContext, and callers that
+// hold a context should prefer it (via asStoreContext) over the plain Store
+// methods.
 type Store interface {
 	// Set sets the digits for the captcha id.
 	Set(id string, digits []byte)
@@ -25,96 +33,268 @@ type Store interface {
 	Get(id string, clear bool) (digits []byte)
 }
 
-// expValue stores timestamp and id of captchas. It is used in the list inside
-// memoryStore for indexing generated captchas by timestamp to enable garbage
-// collection of expired captchas.
+// StoreContext is an optional extension of Store for backends that can fail
+// (network-backed stores such as NewRedisStore) or that want to honor a
+// caller's context cancellation or deadline. Store remains a thin adapter
+// over it: implementations that satisfy StoreContext typically implement
+// Set and Get by calling SetContext/GetContext with context.Background()
+// and discarding the error, preserving the historical silent-failure
+// behavior for callers that only need Store.
+//
+// Nothing in this package calls SetContext or GetContext on its own; the
+// context and the errors reach only callers that invoke these methods
+// directly, or through asStoreContext.
+type StoreContext interface {
+	Store
+
+	// SetContext is the context-aware equivalent of Set. It returns any
+	// backend error encountered (for example a timeout or a lost
+	// connection) instead of swallowing it.
+	SetContext(ctx context.Context, id string, digits []byte) error
+
+	// GetContext is the context-aware equivalent of Get. It returns any
+	// backend error encountered alongside the stored digits.
+	GetContext(ctx context.Context, id string, clear bool) (digits []byte, err error)
+}
+
+// noContextStore adapts a plain Store into a StoreContext for callers that
+// want the context-aware API uniformly, regardless of whether the
+// underlying store supports it. ctx is ignored and no error is ever
+// returned, matching Store's existing silent-failure behavior.
+type noContextStore struct {
+	Store
+}
+
+func (s noContextStore) SetContext(ctx context.Context, id string, digits []byte) error {
+	s.Store.Set(id, digits)
+	return nil
+}
+
+func (s noContextStore) GetContext(ctx context.Context, id string, clear bool) (digits []byte, err error) {
+	return s.Store.Get(id, clear), nil
+}
+
+// asStoreContext returns store as a StoreContext, using its native
+// implementation when store already provides one (as memoryStore and
+// redisStore do), or wrapping it with noContextStore otherwise.
+func asStoreContext(store Store) StoreContext {
+	if sc, ok := store.(StoreContext); ok {
+		return sc
+	}
+	return noContextStore{store}
+}
+
+// expItem is an entry in memoryStore's expiration heap: it tracks when a
+// captcha id expires so that collect can evict expired ids directly instead
+// of scanning every stored id. index is maintained by expHeap and used to
+// remove an item before it expires, e.g. when Get clears it.
+type expItem struct {
+	id    string
+	exp   int64
+	index int
+}
+
+// expHeap is a min-heap of *expItem ordered by expiration time. It
+// implements container/heap.Interface.
+type expHeap []*expItem
+
+func (h expHeap) Len() int           { return len(h) }
+func (h expHeap) Less(i, j int) bool { return h[i].exp < h[j].exp }
+func (h expHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expHeap) Push(x interface{}) {
+	item := x.(*expItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
 
 // memoryStore is an internal store for captcha ids and their values.
 type memoryStore struct {
 	sync.RWMutex
 	digitsById map[string][]byte
-	timeById map[string]int64
+	// itemById and expHeap together index ids by expiration time, so
+	// collect can pop just the expired prefix instead of scanning every
+	// stored id, and Get(clear=true) can remove an id's entry immediately.
+	itemById map[string]*expItem
+	expHeap  expHeap
 	// Number of items stored since last collection.
 	numStored int
 	// Number of saved items that triggers collection.
 	collectNum int
 	// Expiration time of captchas.
 	expiration int64
+	// gcTicker drives background collection and gcDone stops the
+	// goroutine reading from it; both are nil unless the store was
+	// created with NewMemoryStoreWithGC. closeOnce guards Close so that
+	// calling it more than once doesn't panic on an already-closed
+	// gcDone.
+	gcTicker  *time.Ticker
+	gcDone    chan struct{}
+	closeOnce sync.Once
 }
 
 // NewMemoryStore returns a new standard memory store for captchas with the
 // given collection threshold and expiration time (duration). The returned
 // store must be registered with SetCustomStore to replace the default one.
+// Collection only runs when more than collectNum items have been stored
+// since the last run; use NewMemoryStoreWithGC for a store that also
+// collects on a schedule.
 func NewMemoryStore(collectNum int, expiration int64) Store {
+	return newMemoryStore(collectNum, expiration)
+}
+
+// MemoryStoreCloser is a Store that runs background collection and must be
+// closed to stop it. It is returned by NewMemoryStoreWithGC.
+type MemoryStoreCloser interface {
+	Store
+
+	// Close stops the background collection goroutine. It is safe to
+	// call more than once.
+	Close()
+}
+
+// NewMemoryStoreWithGC is like NewMemoryStore, but additionally runs
+// collection every gcInterval regardless of numStored. This keeps memory
+// bounded for stores that fill up once and then sit idle, which
+// NewMemoryStore's numStored-triggered collection would never revisit. Call
+// Close when the store is no longer needed to stop the background
+// goroutine it starts.
+func NewMemoryStoreWithGC(collectNum int, expiration int64, gcInterval time.Duration) MemoryStoreCloser {
+	s := newMemoryStore(collectNum, expiration)
+	s.gcTicker = time.NewTicker(gcInterval)
+	s.gcDone = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-s.gcTicker.C:
+				s.collect()
+			case <-s.gcDone:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Close stops the background collection goroutine started by
+// NewMemoryStoreWithGC. It is a no-op on a store created with
+// NewMemoryStore, and safe to call more than once.
+func (s *memoryStore) Close() {
+	if s.gcTicker == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		s.gcTicker.Stop()
+		close(s.gcDone)
+	})
+}
+
+func newMemoryStore(collectNum int, expiration int64) *memoryStore {
 	s := new(memoryStore)
 	s.digitsById = make(map[string][]byte)
-	s.timeById = make(map[string]int64)
+	s.itemById = make(map[string]*expItem)
 	s.collectNum = collectNum
 	s.expiration = expiration
 	return s
 }
 
 func (s *memoryStore) Set(id string, digits []byte) {
+	s.SetContext(context.Background(), id, digits)
+}
+
+// SetContext is equivalent to Set; memoryStore cannot fail and ctx is
+// ignored, but it is provided so memoryStore satisfies StoreContext.
+func (s *memoryStore) SetContext(ctx context.Context, id string, digits []byte) error {
 	s.Lock()
+	exp := time.Now().Unix() + s.expiration
 	s.digitsById[id] = digits
-	s.timeById[id] = time.Now().Unix()
+	if item, ok := s.itemById[id]; ok {
+		item.exp = exp
+		heap.Fix(&s.expHeap, item.index)
+	} else {
+		item := &expItem{id: id, exp: exp}
+		heap.Push(&s.expHeap, item)
+		s.itemById[id] = item
+	}
 	s.numStored++
 	if s.numStored <= s.collectNum {
 		s.Unlock()
-		return
+		return nil
 	}
 	s.Unlock()
 	go s.collect()
+	return nil
 }
 
 func (s *memoryStore) Get(id string, clear bool) (digits []byte) {
-	if !clear {
-		// When we don't need to clear captcha, acquire read lock.
-		s.RLock()
-		defer s.RUnlock()
-	} else {
-		s.Lock()
-		defer s.Unlock()
-	}
+	digits, _ = s.GetContext(context.Background(), id, clear)
+	return digits
+}
+
+// GetContext is equivalent to Get; memoryStore cannot fail and ctx is
+// ignored, but it is provided so memoryStore satisfies StoreContext.
+func (s *memoryStore) GetContext(ctx context.Context, id string, clear bool) (digits []byte, err error) {
+	// Always acquire the write lock: even when clear is false, an
+	// expired id is evicted here, which mutates digitsById, itemById
+	// and expHeap. Two readers evicting the same id under RLock would
+	// race heap.Remove against itself and could corrupt expHeap's
+	// indices for unrelated ids.
+	s.Lock()
+	defer s.Unlock()
 
 	digits, ok := s.digitsById[id]
 	if !ok {
-		return
+		return nil, nil
 	}
-	t, ok := s.timeById[id]
+	item, ok := s.itemById[id]
 	if !ok {
-		return []byte{}
-	} else {
-		if t+s.expiration < time.Now().Unix() {
-			delete(s.digitsById, id)
-			delete(s.timeById, id)
-			return []byte{}
-		}
+		return []byte{}, nil
+	}
+	if item.exp < time.Now().Unix() {
+		s.evict(item)
+		return []byte{}, nil
 	}
 
 	if clear {
-		delete(s.digitsById, id)
-		delete(s.timeById, id)
-
-		// XXX(dchest) Index (s.timeById) will be cleaned when
-		// collecting expired captchas.  Can't clean it here, because
-		// we don't store reference to expValue in the map.
-		// Maybe store it?
+		s.evict(item)
 	}
-	return
+	return digits, nil
 }
 
-// garbage collection
+// evict removes id's entry from digitsById, itemById and expHeap. The
+// caller must hold s's write lock.
+func (s *memoryStore) evict(item *expItem) {
+	delete(s.digitsById, item.id)
+	delete(s.itemById, item.id)
+	heap.Remove(&s.expHeap, item.index)
+}
+
+// collect evicts expired captchas. Because expHeap is ordered by expiration
+// time, it only needs to pop the prefix of entries that have actually
+// expired, rather than scanning every stored id.
 func (s *memoryStore) collect() {
 	now := time.Now().Unix()
 	s.Lock()
 	defer s.Unlock()
 	s.numStored = 0
 
-	for k, v := range s.timeById {
-		if v+s.expiration < now {
-			delete(s.digitsById, k)
-			delete(s.timeById, k)
-		}
+	for len(s.expHeap) > 0 && s.expHeap[0].exp < now {
+		item := heap.Pop(&s.expHeap).(*expItem)
+		delete(s.digitsById, item.id)
+		delete(s.itemById, item.id)
 	}
 }
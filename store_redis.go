@@ -0,0 +1,73 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisStore is a Store implementation backed by Redis. Unlike memoryStore,
+// it requires no background collection: expiration is delegated to Redis'
+// own TTL, and Get(clear=true) uses GETDEL so that verification is atomic
+// even when captchas are generated and verified by different app instances.
+type redisStore struct {
+	client     redis.UniversalClient
+	keyPrefix  string
+	expiration time.Duration
+}
+
+// NewRedisStore returns a new Redis-backed store for captchas, suitable for
+// deployments with more than one app instance sharing the same Redis. client
+// may be a *redis.Client, *redis.ClusterClient, or any other
+// redis.UniversalClient. Each captcha is stored under keyPrefix+id and
+// expires after the given duration.
+func NewRedisStore(client redis.UniversalClient, keyPrefix string, expiration time.Duration) Store {
+	return &redisStore{
+		client:     client,
+		keyPrefix:  keyPrefix,
+		expiration: expiration,
+	}
+}
+
+func (s *redisStore) key(id string) string {
+	return s.keyPrefix + id
+}
+
+func (s *redisStore) Set(id string, digits []byte) {
+	// Errors are swallowed here for compatibility with Store; use
+	// SetContext to observe them.
+	s.SetContext(context.Background(), id, digits)
+}
+
+// SetContext stores digits under keyPrefix+id with the store's expiration,
+// returning any error the Redis client encounters (timeout, connection
+// loss, etc).
+func (s *redisStore) SetContext(ctx context.Context, id string, digits []byte) error {
+	return s.client.Set(ctx, s.key(id), digits, s.expiration).Err()
+}
+
+func (s *redisStore) Get(id string, clear bool) (digits []byte) {
+	digits, _ = s.GetContext(context.Background(), id, clear)
+	return digits
+}
+
+// GetContext returns the digits stored for id, propagating ctx to the
+// Redis client and returning any error it encounters. When clear is true
+// it uses GETDEL so the read and delete are atomic, which matters when
+// multiple app instances share the same Redis.
+func (s *redisStore) GetContext(ctx context.Context, id string, clear bool) (digits []byte, err error) {
+	if !clear {
+		digits, err = s.client.Get(ctx, s.key(id)).Bytes()
+	} else {
+		digits, err = s.client.GetDel(ctx, s.key(id)).Bytes()
+	}
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return digits, err
+}
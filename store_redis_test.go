@@ -0,0 +1,87 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedisStore(t *testing.T) (*redisStore, *miniredis.Miniredis) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis.Run: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	s, ok := NewRedisStore(client, "captcha:", time.Minute).(*redisStore)
+	if !ok {
+		t.Fatal("NewRedisStore did not return a *redisStore")
+	}
+	return s, mr
+}
+
+func TestRedisStoreSetGet(t *testing.T) {
+	s, _ := newTestRedisStore(t)
+
+	s.Set("id1", []byte("1234"))
+
+	if got := s.Get("id1", false); string(got) != "1234" {
+		t.Fatalf("Get(clear=false) = %q, want %q", got, "1234")
+	}
+	// Not cleared: a second read still finds it.
+	if got := s.Get("id1", false); string(got) != "1234" {
+		t.Fatalf("second Get(clear=false) = %q, want %q", got, "1234")
+	}
+}
+
+func TestRedisStoreGetClear(t *testing.T) {
+	s, _ := newTestRedisStore(t)
+
+	s.Set("id1", []byte("1234"))
+
+	if got := s.Get("id1", true); string(got) != "1234" {
+		t.Fatalf("Get(clear=true) = %q, want %q", got, "1234")
+	}
+	if got := s.Get("id1", false); got != nil {
+		t.Fatalf("Get after clear = %q, want nil", got)
+	}
+}
+
+func TestRedisStoreGetMissing(t *testing.T) {
+	s, _ := newTestRedisStore(t)
+
+	if got := s.Get("missing", false); got != nil {
+		t.Fatalf("Get(missing) = %q, want nil", got)
+	}
+}
+
+func TestRedisStoreExpiration(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+
+	s.Set("id1", []byte("1234"))
+	mr.FastForward(2 * time.Minute)
+
+	if got := s.Get("id1", false); got != nil {
+		t.Fatalf("Get(expired) = %q, want nil", got)
+	}
+}
+
+func TestRedisStoreGetContextError(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	mr.Close()
+
+	if _, err := s.GetContext(context.Background(), "id1", false); err == nil {
+		t.Fatal("GetContext with an unreachable Redis returned a nil error")
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"container/heap"
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeStore is a minimal Store, used to verify noContextStore and
+// asStoreContext without depending on memoryStore or redisStore.
+type fakeStore struct {
+	digits map[string][]byte
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{digits: make(map[string][]byte)}
+}
+
+func (s *fakeStore) Set(id string, digits []byte) {
+	s.digits[id] = digits
+}
+
+func (s *fakeStore) Get(id string, clear bool) (digits []byte) {
+	digits = s.digits[id]
+	if clear {
+		delete(s.digits, id)
+	}
+	return digits
+}
+
+func TestAsStoreContextWrapsPlainStore(t *testing.T) {
+	fs := newFakeStore()
+	sc := asStoreContext(fs)
+
+	if _, ok := sc.(noContextStore); !ok {
+		t.Fatalf("asStoreContext(fakeStore) = %T, want noContextStore", sc)
+	}
+
+	if err := sc.SetContext(context.Background(), "id1", []byte("1234")); err != nil {
+		t.Fatalf("SetContext: %v", err)
+	}
+
+	got, err := sc.GetContext(context.Background(), "id1", false)
+	if err != nil {
+		t.Fatalf("GetContext: %v", err)
+	}
+	if string(got) != "1234" {
+		t.Fatalf("GetContext = %q, want %q", got, "1234")
+	}
+
+	// noContextStore must preserve Store's silent-failure behavior: a
+	// missing id is a nil error, not an error value.
+	got, err = sc.GetContext(context.Background(), "missing", false)
+	if err != nil || got != nil {
+		t.Fatalf("GetContext(missing) = (%q, %v), want (nil, nil)", got, err)
+	}
+}
+
+func TestAsStoreContextPassesThroughNativeImplementation(t *testing.T) {
+	ms := newMemoryStore(1000, 60)
+
+	if sc := asStoreContext(ms); sc != StoreContext(ms) {
+		t.Fatal("asStoreContext(memoryStore) should return the store itself, not a wrapper")
+	}
+}
+
+func TestMemoryStoreCollectExpiresItems(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(1000, 60)
+	s.SetContext(ctx, "id1", []byte("1234"))
+
+	// Force id1 into the past without waiting on a real second boundary.
+	item := s.itemById["id1"]
+	item.exp = time.Now().Unix() - 1
+	heap.Fix(&s.expHeap, item.index)
+
+	s.collect()
+
+	if _, ok := s.digitsById["id1"]; ok {
+		t.Fatal("collect did not remove the expired digits")
+	}
+	if _, ok := s.itemById["id1"]; ok {
+		t.Fatal("collect did not remove the expired itemById entry")
+	}
+	if len(s.expHeap) != 0 {
+		t.Fatalf("collect left %d entries in expHeap, want 0", len(s.expHeap))
+	}
+}
+
+func TestMemoryStoreGetClearRemovesHeapEntryImmediately(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(1000, 60)
+	s.SetContext(ctx, "id1", []byte("1234"))
+
+	got, err := s.GetContext(ctx, "id1", true)
+	if err != nil {
+		t.Fatalf("GetContext(clear=true): %v", err)
+	}
+	if string(got) != "1234" {
+		t.Fatalf("GetContext(clear=true) = %q, want %q", got, "1234")
+	}
+
+	if _, ok := s.itemById["id1"]; ok {
+		t.Fatal("GetContext(clear=true) left id1 in itemById")
+	}
+	if len(s.expHeap) != 0 {
+		t.Fatalf("GetContext(clear=true) left %d entries in expHeap, want 0", len(s.expHeap))
+	}
+}
+
+func TestMemoryStoreSetExistingIDFixesHeapPosition(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(1000, 60)
+	s.SetContext(ctx, "id1", []byte("1111"))
+	s.SetContext(ctx, "id2", []byte("2222"))
+	now := time.Now().Unix()
+
+	// Pin id2 between id1's about-to-be-forced-to-the-past value and its
+	// default ~60s-out expiration, so the two can never tie.
+	item2 := s.itemById["id2"]
+	item2.exp = now + 30
+	heap.Fix(&s.expHeap, item2.index)
+
+	// Make id1 expire far in the past so it sorts first in the heap.
+	item1 := s.itemById["id1"]
+	item1.exp = 0
+	heap.Fix(&s.expHeap, item1.index)
+	if s.expHeap[0].id != "id1" {
+		t.Fatalf("expHeap[0] = %q, want id1", s.expHeap[0].id)
+	}
+
+	// Re-Set must refresh id1's expiration and fix its heap position via
+	// heap.Fix, not just overwrite digitsById and leave a stale entry.
+	s.SetContext(ctx, "id1", []byte("3333"))
+
+	if item1.exp <= now {
+		t.Fatalf("re-Set did not refresh id1's expiration, exp = %d", item1.exp)
+	}
+	if s.expHeap[0].id != "id2" {
+		t.Fatalf("expHeap[0] = %q, want id2; re-Set did not fix id1's heap position", s.expHeap[0].id)
+	}
+	if len(s.itemById) != 2 || len(s.expHeap) != 2 {
+		t.Fatalf("re-Set created a duplicate entry: itemById=%d expHeap=%d, want 2 and 2", len(s.itemById), len(s.expHeap))
+	}
+}
+
+func TestMemoryStoreWithGCCollectsOnSchedule(t *testing.T) {
+	mc := NewMemoryStoreWithGC(1000, 60, 5*time.Millisecond)
+	defer mc.Close()
+	ms := mc.(*memoryStore)
+
+	mc.Set("id1", []byte("1234"))
+	ms.Lock()
+	item := ms.itemById["id1"]
+	item.exp = time.Now().Unix() - 1
+	heap.Fix(&ms.expHeap, item.index)
+	ms.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ms.RLock()
+		_, stillThere := ms.digitsById["id1"]
+		ms.RUnlock()
+		if !stillThere {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("background GC never collected the expired item")
+}
+
+func TestMemoryStoreCloseStopsGCGoroutine(t *testing.T) {
+	mc := NewMemoryStoreWithGC(1000, 60, 5*time.Millisecond)
+	ms := mc.(*memoryStore)
+
+	mc.Close()
+	mc.Close() // must be idempotent, not panic
+
+	mc.Set("id2", []byte("5678"))
+	ms.Lock()
+	item := ms.itemById["id2"]
+	item.exp = time.Now().Unix() - 1
+	heap.Fix(&ms.expHeap, item.index)
+	ms.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	ms.RLock()
+	_, stillThere := ms.digitsById["id2"]
+	ms.RUnlock()
+	if !stillThere {
+		t.Fatal("expired item was collected after Close; the GC goroutine should have stopped")
+	}
+}